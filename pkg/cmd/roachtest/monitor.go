@@ -13,8 +13,12 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/cockroachdb/cockroach/pkg/cmd/roachtest/cluster"
 	"github.com/cockroachdb/cockroach/pkg/cmd/roachtest/option"
@@ -27,6 +31,7 @@ import (
 
 type monitorImpl struct {
 	t interface {
+		Name() string
 		Fatal(...interface{})
 		Failed() bool
 		WorkerStatus(...interface{})
@@ -34,16 +39,56 @@ type monitorImpl struct {
 	l      *logger.Logger
 	nodes  string
 	ctx    context.Context
-	cancel func()
+	cancel context.CancelCauseFunc
 	g      *errgroup.Group
 
 	numTasks  int32 // atomically
 	expDeaths int32 // atomically
+	// draining is set once a registered shutdown signal is received. It's a
+	// pointer (allocated once, in newMonitor) rather than a plain field so
+	// that NotifySignals's goroutine can hold a reference to it without
+	// holding a reference to m itself; see the comment on NotifySignals.
+	draining *int32 // atomically
+
+	// sem bounds the number of concurrent in-flight tasks spawned via Go or
+	// TryGo. It is accessed via atomic.Pointer rather than a bare field
+	// because SetLimit can be called concurrently with Go/TryGo (e.g. one
+	// goroutine tightening the limit while another spawns tasks under the
+	// old one). When unbounded it holds either a nil pointer (SetLimit never
+	// called) or a pointer to a nil channel (SetLimit called with n <= 0).
+	sem atomic.Pointer[chan struct{}]
+
+	// wg tracks the wait()-loop goroutines (including any started by
+	// NotifySignals) so that wait() doesn't return before all of them have
+	// exited. Like draining, it's a pointer (allocated once, in newMonitor)
+	// so NotifySignals's goroutine doesn't need a reference to m to call
+	// Add/Done on it.
+	wg *sync.WaitGroup
+
+	subsMu      sync.Mutex
+	subscribers []*monitorSubscriber
+	// subsClosed is set once the event-watching goroutine in wait() has torn
+	// down (and so will never publish or close another subscriber again).
+	subsClosed bool
 }
 
+// monitorSubscriber is a single Subscribe registration: events matching
+// filter are forwarded onto ch, dropping (and counting) them if the
+// subscriber isn't keeping up.
+type monitorSubscriber struct {
+	filter  func(install.MonitorEvent) bool
+	ch      chan install.MonitorEvent
+	dropped int32 // atomically
+}
+
+// subscriberBufSize bounds how many unconsumed events a Subscribe channel
+// will buffer before new events are dropped.
+const subscriberBufSize = 32
+
 func newMonitor(
 	ctx context.Context,
 	t interface {
+		Name() string
 		Fatal(...interface{})
 		Failed() bool
 		WorkerStatus(...interface{})
@@ -53,15 +98,63 @@ func newMonitor(
 	opts ...option.Option,
 ) *monitorImpl {
 	m := &monitorImpl{
-		t:     t,
-		l:     t.L(),
-		nodes: c.MakeNodes(opts...),
+		t:        t,
+		l:        t.L(),
+		nodes:    c.MakeNodes(opts...),
+		draining: new(int32),
+		wg:       &sync.WaitGroup{},
 	}
-	m.ctx, m.cancel = context.WithCancel(ctx)
+	m.ctx, m.cancel = context.WithCancelCause(ctx)
 	m.g, m.ctx = errgroup.WithContext(m.ctx)
+
+	// If the monitor is garbage-collected without Wait/WaitE ever having been
+	// called, it's almost always a bug: the caller forgot to drain the
+	// monitor, which leaks the worker errgroup (and any tasks blocked on
+	// <-ctx.Done(), waiting for a cancellation that, absent Wait/WaitE, will
+	// never come) for the remainder of the process. Catch this with a
+	// finalizer rather than relying on every call site to get cleanup right.
+	//
+	// This only works because tasks spawned via Go/TryGo (see wrapTask) don't
+	// themselves hold a reference to m: if they did, a task blocked forever
+	// on <-ctx.Done() would keep m reachable and this finalizer would never
+	// fire in precisely the case it's meant to catch.
+	runtime.SetFinalizer(m, (*monitorImpl).finalize)
 	return m
 }
 
+// errMonitorAbandoned is the cancellation cause used when a monitorImpl is
+// garbage-collected without Wait/WaitE ever having been called.
+var errMonitorAbandoned = errors.New("monitor was garbage collected without Wait/WaitE being called")
+
+// finalize is installed as m's finalizer in newMonitor and is cleared by
+// Wait/WaitE on entry. It only runs if the monitor was abandoned, in which
+// case canceling m.ctx unblocks any tasks still waiting on it so they can
+// exit instead of leaking for the remainder of the process.
+func (m *monitorImpl) finalize() {
+	m.l.Printf("WARNING: monitor for test %q was never waited on; this likely leaked "+
+		"its worker goroutines until now", m.t.Name())
+	m.cancel(errMonitorAbandoned)
+}
+
+// errUnexpectedNodeDeath is the cancellation cause used when the monitor
+// observes a node dying without a corresponding ExpectDeath(s) call.
+type errUnexpectedNodeDeath struct {
+	info install.MonitorEvent
+}
+
+func (e errUnexpectedNodeDeath) Error() string {
+	return fmt.Sprintf("unexpected node event: %s", e.info)
+}
+
+// CancelCause returns the error that caused the monitor's context to be
+// canceled, or nil if it has not yet been canceled. This lets tasks passed
+// to Go/TryGo/GoWithCancel distinguish, via context.Cause(ctx), why they were
+// stopped: a peer task's error, an unexpected node death, or the parent
+// context going away.
+func (m *monitorImpl) CancelCause() error {
+	return context.Cause(m.ctx)
+}
+
 // ExpectDeath lets the monitor know that a node is about to be killed, and that
 // this should be ignored.
 func (m *monitorImpl) ExpectDeath() {
@@ -80,10 +173,57 @@ func (m *monitorImpl) ResetDeaths() {
 
 var errTestFatal = errors.New("t.Fatal() was called")
 
-func (m *monitorImpl) Go(fn func(context.Context) error) {
-	atomic.AddInt32(&m.numTasks, 1)
+// SetLimit bounds the number of tasks spawned via Go or TryGo that may be
+// in-flight at once. A limit of n means that the (n+1)th call to Go will
+// block until one of the prior n tasks completes, and TryGo will return
+// false instead of blocking. A non-positive n removes the limit.
+//
+// SetLimit only affects tasks spawned after it returns: each task captures
+// the semaphore that was current when it was spawned and releases that same
+// one on completion, so calling SetLimit again (even to change or clear the
+// limit) while earlier tasks are still in flight is safe and does not
+// corrupt their accounting.
+func (m *monitorImpl) SetLimit(n int) {
+	if n <= 0 {
+		var nilSem chan struct{}
+		m.sem.Store(&nilSem)
+		return
+	}
+	sem := make(chan struct{}, n)
+	m.sem.Store(&sem)
+}
+
+// currentSem returns the semaphore currently installed by SetLimit, or nil
+// if SetLimit has never been called (or was last called with n <= 0).
+func (m *monitorImpl) currentSem() chan struct{} {
+	p := m.sem.Load()
+	if p == nil {
+		return nil
+	}
+	return *p
+}
 
-	m.g.Go(func() (err error) {
+// wrapTask wraps fn with the panic-recovery and WorkerStatus cleanup shared
+// by Go and TryGo, and releases sem (the concurrency-limiting semaphore
+// token acquired by the caller, if any) when the task completes. sem is
+// passed in explicitly, rather than read from m.sem, so that a later
+// SetLimit call can't cause a task to release into the wrong semaphore (or
+// block forever releasing into a nil one).
+//
+// The returned closure deliberately captures ctx and t (besides sem and fn),
+// not m itself: it's passed straight to m.g.Go, which can keep it (and whatever it
+// captures) running indefinitely if fn never returns, e.g. because it's
+// blocked on <-ctx.Done() waiting for a cancellation that, absent Wait/WaitE
+// ever being called, will never come. If the closure captured m, that would
+// pin m as reachable for as long as such a task runs, defeating the
+// abandoned-monitor finalizer installed in newMonitor, which relies on m
+// becoming unreachable once its caller drops it.
+func (m *monitorImpl) wrapTask(sem chan struct{}, fn func(context.Context) error) func() error {
+	ctx, t := m.ctx, m.t
+	return func() (err error) {
+		if sem != nil {
+			defer func() { <-sem }()
+		}
 		defer func() {
 			r := recover()
 			if r == nil {
@@ -104,22 +244,217 @@ func (m *monitorImpl) Go(fn func(context.Context) error) {
 			err = errors.WithStack(rErr)
 		}()
 		// Automatically clear the worker status message when the goroutine exits.
-		defer m.t.WorkerStatus()
-		return fn(m.ctx)
-	})
+		defer t.WorkerStatus()
+		return fn(ctx)
+	}
+}
+
+func (m *monitorImpl) Go(fn func(context.Context) error) {
+	sem := m.currentSem()
+	if sem != nil {
+		sem <- struct{}{}
+	}
+	atomic.AddInt32(&m.numTasks, 1)
+	m.g.Go(m.wrapTask(sem, fn))
+}
+
+// TryGo is like Go, but if SetLimit has been called and the limit is
+// currently saturated, it returns false immediately instead of blocking
+// until a slot frees up. It returns true if the task was spawned.
+func (m *monitorImpl) TryGo(fn func(context.Context) error) bool {
+	sem := m.currentSem()
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt32(&m.numTasks, 1)
+	m.g.Go(m.wrapTask(sem, fn))
+	return true
 }
 
 // GoWithCancel is like Go, but returns a function that can be used to cancel
-// the goroutine.
-func (m *monitorImpl) GoWithCancel(fn func(context.Context) error) func() {
-	ctx, cancel := context.WithCancel(m.ctx)
+// the goroutine. The returned CancelCauseFunc records why the goroutine's
+// context was canceled, retrievable via context.Cause(ctx) inside fn.
+func (m *monitorImpl) GoWithCancel(fn func(context.Context) error) context.CancelCauseFunc {
+	ctx, cancel := context.WithCancelCause(m.ctx)
 	m.Go(func(_ context.Context) error {
 		return fn(ctx)
 	})
 	return cancel
 }
 
+// errShutdownRequested is the cancellation cause used when NotifySignals
+// observes one of its registered signals.
+var errShutdownRequested = errors.New("shutdown requested")
+
+// NotifySignals arranges for the monitor to drain gracefully when the
+// process receives one of sigs (typically SIGINT/SIGTERM), instead of
+// leaving the roachprod monitor subprocess and worker goroutines behind.
+// Once a signal is received, the monitor stops treating subsequent
+// MonitorNodeDead events as unexpected, cancels its context with
+// errShutdownRequested, and wait() returns nil if no other error has
+// already been recorded.
+func (m *monitorImpl) NotifySignals(sigs ...os.Signal) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sigs...)
+
+	// Capture everything the goroutine below needs out of m before spawning
+	// it, rather than letting the closure reference m itself: like wrapTask
+	// (see the comment there), this goroutine can block in the select below
+	// for as long as the process runs, and a closure capturing m would pin it
+	// reachable for that whole time, defeating the abandoned-monitor
+	// finalizer in exactly the case (NotifySignals called, then Wait/WaitE
+	// never called) that finalizer exists to catch. draining and wg are
+	// themselves pointers to separately-allocated memory (see their field
+	// comments), so copying them here doesn't pin m either.
+	ctx := m.ctx
+	cancel := m.cancel
+	l := m.l
+	t := m.t
+	draining := m.draining
+	wg := m.wg
+
+	wg.Add(1)
+	go func() {
+		defer func() {
+			signal.Stop(sigCh)
+			wg.Done()
+		}()
+		select {
+		case s := <-sigCh:
+			l.Printf("Monitor for test %q received %s, draining", t.Name(), s)
+			atomic.StoreInt32(draining, 1)
+			cancel(errShutdownRequested)
+		case <-ctx.Done():
+		}
+	}()
+}
+
+// Subscribe returns a channel of the roachprod monitor events observed by
+// this monitor (the same stream driving ExpectDeath accounting), restricted
+// to those for which filter returns true, along with an unsubscribe func
+// that removes the subscription and closes the channel. Callers that don't
+// intend to keep the subscription for the monitor's whole lifetime (e.g.
+// ExpectEvent, WaitForEvent) must call unsubscribe once they're done with
+// it, or every later event keeps getting fanned out to (and eventually
+// dropped from, once its buffer fills) an abandoned channel nobody reads
+// from anymore. Pass a nil filter to observe every event. The channel is
+// also closed once the monitor stops watching for events (i.e. once wait()
+// returns), at which point unsubscribe is a no-op; if that has already
+// happened by the time Subscribe is called, it returns an already-closed
+// channel and a no-op unsubscribe rather than registering a subscriber that
+// could never be serviced. Subscribers that don't keep up have events
+// dropped rather than blocking the monitor; drops are logged.
+func (m *monitorImpl) Subscribe(
+	filter func(install.MonitorEvent) bool,
+) (ch <-chan install.MonitorEvent, unsubscribe func()) {
+	sub := &monitorSubscriber{
+		filter: filter,
+		ch:     make(chan install.MonitorEvent, subscriberBufSize),
+	}
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	if m.subsClosed {
+		close(sub.ch)
+		return sub.ch, func() {}
+	}
+	m.subscribers = append(m.subscribers, sub)
+	return sub.ch, func() { m.unsubscribe(sub) }
+}
+
+// unsubscribe removes sub from m.subscribers and closes its channel, unless
+// the monitor has already torn down (in which case closeSubscribers already
+// did both).
+func (m *monitorImpl) unsubscribe(sub *monitorSubscriber) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	if m.subsClosed {
+		return
+	}
+	for i, s := range m.subscribers {
+		if s == sub {
+			m.subscribers = append(m.subscribers[:i:i], m.subscribers[i+1:]...)
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// publish fans info out to every subscriber whose filter matches it.
+func (m *monitorImpl) publish(info install.MonitorEvent) {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	for _, sub := range m.subscribers {
+		if sub.filter != nil && !sub.filter(info) {
+			continue
+		}
+		select {
+		case sub.ch <- info:
+		default:
+			n := atomic.AddInt32(&sub.dropped, 1)
+			m.l.Printf("Monitor event subscriber buffer full, dropped event (%d total dropped): %s", n, info)
+		}
+	}
+}
+
+// closeSubscribers closes every subscriber channel and marks the monitor as
+// done publishing events, so that any later Subscribe call gets an
+// already-closed channel instead of a subscriber that would never be
+// serviced. It must only be called after the monitor has stopped publishing
+// events.
+func (m *monitorImpl) closeSubscribers() {
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	m.subsClosed = true
+	for _, sub := range m.subscribers {
+		close(sub.ch)
+	}
+	m.subscribers = nil
+}
+
+// ExpectEvent waits up to timeout for a monitor event matching matcher, e.g.
+// "node n3 came back up". It returns an error if the monitor stops watching
+// for events, or if timeout elapses, before a matching event is observed.
+func (m *monitorImpl) ExpectEvent(
+	matcher func(install.MonitorEvent) bool, timeout time.Duration,
+) (install.MonitorEvent, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	ch, unsubscribe := m.Subscribe(matcher)
+	defer unsubscribe()
+	select {
+	case info, ok := <-ch:
+		if !ok {
+			return install.MonitorEvent{}, errors.New("monitor stopped before matching event was observed")
+		}
+		return info, nil
+	case <-timer.C:
+		return install.MonitorEvent{}, errors.Errorf("timed out after %s waiting for matching monitor event", timeout)
+	}
+}
+
+// WaitForEvent blocks until a monitor event matching matcher is observed, or
+// the monitor stops watching for events. Use ExpectEvent instead if the wait
+// should be bounded.
+func (m *monitorImpl) WaitForEvent(matcher func(install.MonitorEvent) bool) (install.MonitorEvent, error) {
+	ch, unsubscribe := m.Subscribe(matcher)
+	defer unsubscribe()
+	info, ok := <-ch
+	if !ok {
+		return install.MonitorEvent{}, errors.New("monitor stopped before matching event was observed")
+	}
+	return info, nil
+}
+
 func (m *monitorImpl) WaitE() error {
+	// We're about to wait on the monitor properly; the abandoned-monitor
+	// finalizer no longer applies.
+	runtime.SetFinalizer(m, nil)
+
 	if m.t.Failed() {
 		// If the test has failed, don't try to limp along.
 		return errors.New("already failed")
@@ -129,6 +464,7 @@ func (m *monitorImpl) WaitE() error {
 }
 
 func (m *monitorImpl) Wait() {
+	runtime.SetFinalizer(m, nil)
 	if m.t.Failed() {
 		// If the test has failed, don't try to limp along.
 		return
@@ -178,49 +514,55 @@ func (m *monitorImpl) wait() error {
 	// task for the monitor. This check enables the roachtest monitor to
 	// be used in cases where we just want to monitor events in the
 	// cluster without running any background tasks through the monitor.
-	var wg sync.WaitGroup
 	if atomic.LoadInt32(&m.numTasks) > 0 {
-		wg.Add(1)
+		m.wg.Add(1)
 		go func() {
-			defer func() {
-				m.cancel()
-				wg.Done()
-			}()
-			setErr(errors.Wrap(m.g.Wait(), "function passed to monitor.Go failed"))
+			defer m.wg.Done()
+			gErr := errors.Wrap(m.g.Wait(), "function passed to monitor.Go failed")
+			setErr(gErr)
+			m.cancel(gErr)
 		}()
 	}
 
 	// 2. The second goroutine reads from the monitoring channel, watching for any
 	// unexpected death events.
-	wg.Add(1)
+	m.wg.Add(1)
 	go func() {
-		defer func() {
-			m.cancel()
-			wg.Done()
-		}()
+		defer m.wg.Done()
+		defer m.closeSubscribers()
 
 		eventsCh, err := roachprod.Monitor(m.ctx, m.l, m.nodes, install.MonitorOpts{})
 		if err != nil {
-			setErr(errors.Wrap(err, "monitor command failure"))
+			wErr := errors.Wrap(err, "monitor command failure")
+			setErr(wErr)
+			m.cancel(wErr)
 			return
 		}
 
 		for info := range eventsCh {
+			m.publish(info)
+
 			_, isDeath := info.Event.(install.MonitorNodeDead)
 			isExpectedDeath := isDeath && atomic.AddInt32(&m.expDeaths, -1) >= 0
+			isDraining := atomic.LoadInt32(m.draining) > 0
 			var expectedDeathStr string
 			if isExpectedDeath {
 				expectedDeathStr = ": expected"
+			} else if isDraining {
+				expectedDeathStr = ": draining"
 			}
 			m.l.Printf("Monitor event: %s%s", info, expectedDeathStr)
 
-			if isDeath && !isExpectedDeath {
-				setErr(fmt.Errorf("unexpected node event: %s", info))
+			if isDeath && !isExpectedDeath && !isDraining {
+				dErr := errUnexpectedNodeDeath{info: info}
+				setErr(dErr)
+				m.cancel(dErr)
 				return
 			}
 		}
+		m.cancel(context.Canceled)
 	}()
 
-	wg.Wait()
+	m.wg.Wait()
 	return err
 }
@@ -0,0 +1,349 @@
+// Copyright 2021 The Cockroach Authors.
+//
+// Use of this software is governed by the Business Source License
+// included in the file licenses/BSL.txt.
+//
+// As of the Change Date specified in that file, in accordance with
+// the Business Source License, use of this software will be governed
+// by the Apache License, Version 2.0, included in the file
+// licenses/APL.txt.
+
+package main
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/cockroach/pkg/roachprod/install"
+	"github.com/cockroachdb/cockroach/pkg/roachprod/logger"
+	"github.com/cockroachdb/errors"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMonitorTest is a minimal implementation of the anonymous interface
+// monitorImpl.t expects, for exercising monitorImpl without a real roachtest
+// or cluster.
+type fakeMonitorTest struct {
+	failed int32 // atomically
+}
+
+func (t *fakeMonitorTest) Name() string { return "fake-monitor-test" }
+
+func (t *fakeMonitorTest) Fatal(...interface{}) {
+	atomic.StoreInt32(&t.failed, 1)
+}
+
+func (t *fakeMonitorTest) Failed() bool {
+	return atomic.LoadInt32(&t.failed) != 0
+}
+
+func (t *fakeMonitorTest) WorkerStatus(...interface{}) {}
+
+// newTestMonitorImpl builds a monitorImpl the same way newMonitor does,
+// without requiring a real cluster.Cluster: none of the behavior exercised
+// by these tests depends on m.nodes, and constructing one would otherwise
+// drag in roachprod/cluster test fixtures.
+func newTestMonitorImpl(t *testing.T) (*monitorImpl, *fakeMonitorTest) {
+	cfg := logger.Config{}
+	l, err := cfg.NewLogger("")
+	require.NoError(t, err)
+
+	ft := &fakeMonitorTest{}
+	m := &monitorImpl{t: ft, l: l, draining: new(int32), wg: &sync.WaitGroup{}}
+	m.ctx, m.cancel = context.WithCancelCause(context.Background())
+	m.g, m.ctx = errgroup.WithContext(m.ctx)
+	return m, ft
+}
+
+func TestMonitorSetLimitBoundsConcurrency(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	m.SetLimit(2)
+
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	for i := 0; i < 2; i++ {
+		m.Go(func(context.Context) error {
+			started <- struct{}{}
+			<-release
+			return nil
+		})
+	}
+	<-started
+	<-started
+
+	require.False(t, m.TryGo(func(context.Context) error { return nil }),
+		"TryGo should not spawn a task while the limit is saturated")
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return m.TryGo(func(context.Context) error { return nil })
+	}, time.Second, time.Millisecond, "TryGo should succeed once a slot frees up")
+
+	require.NoError(t, m.g.Wait())
+}
+
+// TestMonitorSetLimitChangeDoesNotCorruptInFlightTasks is a regression test:
+// a task must release into the semaphore it actually acquired from, not
+// whatever m.sem happens to point to when it completes.
+func TestMonitorSetLimitChangeDoesNotCorruptInFlightTasks(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	m.SetLimit(1)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	m.Go(func(context.Context) error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	// Change (and later clear) the limit while the task above is still in
+	// flight.
+	m.SetLimit(5)
+	m.SetLimit(0)
+
+	close(release)
+	require.NoError(t, m.g.Wait())
+
+	// A fresh task spawned now must not be affected by the old task's
+	// release; with the limit cleared, TryGo should never fail.
+	require.True(t, m.TryGo(func(context.Context) error { return nil }))
+	require.NoError(t, m.g.Wait())
+}
+
+// TestMonitorSetLimitConcurrentWithGoIsRaceFree is a regression test: SetLimit
+// must be safe to call concurrently with Go/TryGo (e.g. one goroutine
+// tightening the limit while another fans out tasks under the old one).
+// It doesn't assert anything beyond completing without error; its value is
+// in failing under `go test -race`, which roachtest's CI runs under.
+func TestMonitorSetLimitConcurrentWithGoIsRaceFree(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.SetLimit(i%5 + 1)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			m.TryGo(func(context.Context) error { return nil })
+		}
+	}()
+	wg.Wait()
+
+	require.NoError(t, m.g.Wait())
+}
+
+func TestMonitorCancelCause(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	require.NoError(t, m.CancelCause())
+
+	sentinel := errors.New("boom")
+	m.cancel(sentinel)
+	require.ErrorIs(t, m.CancelCause(), sentinel)
+	require.ErrorIs(t, m.ctx.Err(), context.Canceled)
+}
+
+func TestMonitorGoWithCancelPropagatesCause(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	causeCh := make(chan error, 1)
+	cancel := m.GoWithCancel(func(ctx context.Context) error {
+		<-ctx.Done()
+		causeCh <- context.Cause(ctx)
+		return nil
+	})
+
+	sentinel := errors.New("task-specific cancellation")
+	cancel(sentinel)
+
+	require.ErrorIs(t, <-causeCh, sentinel)
+	require.NoError(t, m.g.Wait())
+}
+
+// TestMonitorFinalizerDetectsAbandonment verifies the abandoned-monitor
+// finalizer actually fires once its only reference is dropped. No task is
+// spawned here, so it does not exercise wrapTask's (see monitor.go)
+// avoidance of capturing m on behalf of an in-flight task.
+func TestMonitorFinalizerDetectsAbandonment(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	ctx := m.ctx
+	runtime.SetFinalizer(m, (*monitorImpl).finalize)
+	m = nil
+
+	require.Eventually(t, func() bool {
+		runtime.GC()
+		return context.Cause(ctx) != nil
+	}, 5*time.Second, 10*time.Millisecond, "finalizer should cancel ctx once the monitor becomes unreachable")
+	require.ErrorIs(t, context.Cause(ctx), errMonitorAbandoned)
+}
+
+// TestMonitorWaitEClearsFinalizer verifies that WaitE clears the finalizer
+// on entry, regardless of which branch it then takes.
+func TestMonitorWaitEClearsFinalizer(t *testing.T) {
+	m, ft := newTestMonitorImpl(t)
+	ft.Fatal() // make t.Failed() true so WaitE returns before touching roachprod
+	runtime.SetFinalizer(m, (*monitorImpl).finalize)
+
+	require.Error(t, m.WaitE())
+
+	ctx := m.ctx
+	m = nil
+	for i := 0; i < 10; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, context.Cause(ctx), "WaitE should have cleared the finalizer before it had a chance to fire")
+}
+
+// TestMonitorNotifySignalsDrains verifies that receiving a registered signal
+// transitions the monitor into draining and cancels its context with
+// errShutdownRequested.
+func TestMonitorNotifySignalsDrains(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	m.NotifySignals(syscall.SIGUSR1)
+
+	proc, err := os.FindProcess(os.Getpid())
+	require.NoError(t, err)
+	require.NoError(t, proc.Signal(syscall.SIGUSR1))
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(m.draining) > 0
+	}, time.Second, time.Millisecond, "monitor should observe the signal and start draining")
+	// draining is set just before the context is canceled; wait for the
+	// signal goroutine to exit so the cancellation has happened too.
+	m.wg.Wait()
+	require.ErrorIs(t, context.Cause(m.ctx), errShutdownRequested)
+}
+
+func TestMonitorPublishFansOutToMatchingSubscribers(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	allCh, _ := m.Subscribe(nil)
+	deathCh, _ := m.Subscribe(func(info install.MonitorEvent) bool {
+		_, isDeath := info.Event.(install.MonitorNodeDead)
+		return isDeath
+	})
+
+	death := install.MonitorEvent{Event: install.MonitorNodeDead{}}
+	other := install.MonitorEvent{}
+
+	m.publish(death)
+	m.publish(other)
+
+	require.Equal(t, death, <-allCh)
+	require.Equal(t, other, <-allCh)
+
+	require.Equal(t, death, <-deathCh)
+	select {
+	case info := <-deathCh:
+		t.Fatalf("deathCh should not have received the non-death event, got %+v", info)
+	default:
+	}
+}
+
+func TestMonitorPublishDropsWhenSubscriberBufferFull(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	_, _ = m.Subscribe(nil) // left unread so its buffer fills up
+
+	m.subsMu.Lock()
+	sub := m.subscribers[0]
+	m.subsMu.Unlock()
+
+	const overflow = 5
+	for i := 0; i < subscriberBufSize+overflow; i++ {
+		m.publish(install.MonitorEvent{})
+	}
+	require.EqualValues(t, overflow, atomic.LoadInt32(&sub.dropped))
+}
+
+// TestMonitorSubscribeAfterCloseReturnsClosedChannel is a regression test:
+// Subscribe called after the monitor has stopped watching events must not
+// register a subscriber that will never be serviced.
+func TestMonitorSubscribeAfterCloseReturnsClosedChannel(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	m.closeSubscribers()
+
+	ch, unsubscribe := m.Subscribe(nil)
+	_, ok := <-ch
+	require.False(t, ok, "Subscribe after close should return an already-closed channel")
+	unsubscribe() // must be a harmless no-op
+}
+
+func TestMonitorWaitForEventAfterCloseReturnsPromptly(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+	m.closeSubscribers()
+
+	_, err := m.WaitForEvent(nil)
+	require.Error(t, err)
+}
+
+func TestMonitorExpectEventTimesOut(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	_, err := m.ExpectEvent(func(install.MonitorEvent) bool { return false }, 10*time.Millisecond)
+	require.Error(t, err)
+}
+
+// TestMonitorExpectEventUnsubscribesAfterMatch is a regression test:
+// ExpectEvent must unsubscribe once it has its matching event, or every
+// later call leaves behind a subscriber that nothing ever reads from again.
+func TestMonitorExpectEventUnsubscribesAfterMatch(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.publish(install.MonitorEvent{Event: install.MonitorNodeDead{}})
+	}()
+
+	_, err := m.ExpectEvent(func(install.MonitorEvent) bool { return true }, time.Second)
+	require.NoError(t, err)
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	require.Empty(t, m.subscribers, "ExpectEvent should unsubscribe once it observes a matching event")
+}
+
+// TestMonitorExpectEventUnsubscribesOnTimeout is the timeout-path analog of
+// TestMonitorExpectEventUnsubscribesAfterMatch.
+func TestMonitorExpectEventUnsubscribesOnTimeout(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	_, err := m.ExpectEvent(func(install.MonitorEvent) bool { return false }, 10*time.Millisecond)
+	require.Error(t, err)
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	require.Empty(t, m.subscribers, "ExpectEvent should unsubscribe on timeout")
+}
+
+// TestMonitorWaitForEventUnsubscribesAfterMatch mirrors
+// TestMonitorExpectEventUnsubscribesAfterMatch for WaitForEvent.
+func TestMonitorWaitForEventUnsubscribesAfterMatch(t *testing.T) {
+	m, _ := newTestMonitorImpl(t)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		m.publish(install.MonitorEvent{Event: install.MonitorNodeDead{}})
+	}()
+
+	_, err := m.WaitForEvent(func(install.MonitorEvent) bool { return true })
+	require.NoError(t, err)
+
+	m.subsMu.Lock()
+	defer m.subsMu.Unlock()
+	require.Empty(t, m.subscribers, "WaitForEvent should unsubscribe once it observes a matching event")
+}